@@ -1,6 +1,8 @@
 package dependency
 
 import (
+	"math/rand"
+	"sync/atomic"
 	"time"
 
 	"github.com/juju/errors"
@@ -12,12 +14,22 @@ import (
 
 var logger = loggo.GetLogger("juju.worker.dependency")
 
+// defaultMaxDelay is used in place of a zero or negative maxDelay passed to
+// NewEngine, so that a persistently broken manifold always backs off to some
+// bounded cadence rather than literally doubling forever.
+const defaultMaxDelay = 5 * time.Minute
+
 // workerInfo stores what an engine needs to know about the worker for a given
 // Manifold.
 type workerInfo struct {
-	starting bool
-	stopping bool
-	worker   worker.Worker
+	starting          bool
+	stopping          bool
+	uninstalling      bool
+	worker            worker.Worker
+	startedAt         time.Time
+	lastError         error
+	restartCount      int
+	consecutiveErrors int
 }
 
 // stopped returns true unless the worker is either assigned or starting.
@@ -31,6 +43,38 @@ func (info workerInfo) stopped() bool {
 	return true
 }
 
+// state returns a human-readable summary of the worker's current status,
+// for use in Engine.Report.
+func (info workerInfo) state() string {
+	switch {
+	case info.starting:
+		return "starting"
+	case info.uninstalling:
+		return "uninstalling"
+	case info.stopping:
+		return "stopping"
+	case info.worker != nil:
+		return "running"
+	}
+	return "stopped"
+}
+
+// report returns a snapshot of info for use in Engine.Report.
+func (info workerInfo) report() map[string]interface{} {
+	result := map[string]interface{}{
+		"state":              info.state(),
+		"restart-count":      info.restartCount,
+		"consecutive-errors": info.consecutiveErrors,
+	}
+	if !info.startedAt.IsZero() {
+		result["started-at"] = info.startedAt
+	}
+	if info.lastError != nil {
+		result["error"] = info.lastError.Error()
+	}
+	return result
+}
+
 // installTicket is used by engine to induce installation of a named manifold
 // and pass on any errors encountered in the process.
 type installTicket struct {
@@ -53,6 +97,52 @@ type stoppedTicket struct {
 	error error
 }
 
+// reportTicket is used by engine to request a snapshot of the current state
+// of every installed manifold.
+type reportTicket struct {
+	result chan<- map[string]interface{}
+}
+
+// uninstallTicket is used by engine to induce removal of a named manifold
+// and pass on any errors encountered in the process.
+type uninstallTicket struct {
+	name   string
+	result chan<- error
+}
+
+// replaceTicket is used by engine to induce replacement of a named
+// manifold's definition and pass on any errors encountered in the process.
+type replaceTicket struct {
+	name     string
+	manifold Manifold
+	result   chan<- error
+}
+
+// Engine is the interface by which workers are started, stopped, and
+// notified of changes to the workers they depend on.
+type Engine interface {
+	worker.Worker
+
+	// Install causes the Engine to accept responsibility for maintaining a
+	// worker corresponding to the supplied manifold, starting it as soon
+	// as its dependencies are met and restarting it whenever it fails.
+	Install(name string, manifold Manifold) error
+
+	// Uninstall causes the Engine to stop maintaining the named manifold,
+	// and to bounce every manifold that depends on it so that they notice
+	// its absence. It is a no-op if the manifold is not installed.
+	Uninstall(name string) error
+
+	// Replace swaps the definition of an already-installed manifold for a
+	// new one, after checking that the new Inputs are all themselves
+	// installed, and bounces the manifold's worker (and its dependents) so
+	// that the replacement takes effect.
+	Replace(name string, manifold Manifold) error
+
+	// Report is part of the Reporter interface.
+	Report() map[string]interface{}
+}
+
 // engine maintains workers corresponding to its installed manifolds, and
 // restarts them whenever their dependencies change.
 type engine struct {
@@ -61,6 +151,17 @@ type engine struct {
 	// isFatal allows errors generated by workers to stop the engine.
 	isFatal func(error) bool
 
+	// worstError decides which of two fatal errors is more important, so
+	// that the engine can report the most significant one even when
+	// several workers die around the same time. It's consulted before
+	// engine.tomb.Kill is ever called, because a tomb only remembers the
+	// first reason it's given.
+	worstError func(err0, err1 error) error
+
+	// fatalError holds the worst fatal error seen so far, as determined
+	// by worstError; it's what the engine is shutting down because of.
+	fatalError error
+
 	// errorDelay controls how long the engine waits before restarting a worker
 	// that encountered an unknown error.
 	errorDelay time.Duration
@@ -69,6 +170,23 @@ type engine struct {
 	// that was deliberately shut down because its dependencies changed.
 	bounceDelay time.Duration
 
+	// maxDelay caps the exponential backoff applied to a worker that keeps
+	// returning errors, so a persistently broken manifold retries at this
+	// interval (plus jitter) rather than ever slower. It is always positive:
+	// NewEngine substitutes defaultMaxDelay for a zero or negative value.
+	maxDelay time.Duration
+
+	// rand supplies the jitter applied on top of the exponential backoff
+	// delay, so that many simultaneously-crash-looping workers don't all
+	// retry in lockstep.
+	rand *rand.Rand
+
+	// startTokens limits how many manifold workers may be starting up at
+	// once, by requiring runWorker to hold a token for the duration of its
+	// call to manifold.Start. It's nil if no limit was configured, in
+	// which case starts are never throttled.
+	startTokens chan struct{}
+
 	// manifolds holds the installed manifolds by name.
 	manifolds map[string]Manifold
 
@@ -78,27 +196,78 @@ type engine struct {
 	// current holds the active worker information for each installed manifold.
 	current map[string]workerInfo
 
-	install chan installTicket
-	started chan startedTicket
-	stopped chan stoppedTicket
+	// generations holds, for each installed manifold, a counter that's
+	// bumped every time its worker is replaced (including by nothing, on
+	// stop, or by a fresh one, on start). start snapshots the relevant
+	// counters' values synchronously on the loop goroutine and hands the
+	// snapshot to runWorker, which compares the live values against it
+	// from its own goroutine via sync/atomic -- never by reading
+	// engine.current directly -- so it can tell a Manifold's Start func
+	// that one of its inputs changed out from under it mid-start.
+	generations map[string]*int64
+
+	install   chan installTicket
+	started   chan startedTicket
+	stopped   chan stoppedTicket
+	report    chan reportTicket
+	uninstall chan uninstallTicket
+	replace   chan replaceTicket
 }
 
 // NewEngine returns an Engine that will maintain any Installed Manifolds until
 // either the engine is killed or one of the manifolds' workers returns an error
-// that satisfies isFatal.
-func NewEngine(isFatal func(error) bool, errorDelay, bounceDelay time.Duration) Engine {
+// that satisfies isFatal. If several such errors occur around the same time,
+// worstError is used to choose the one the engine eventually dies with; if
+// worstError is nil, the first fatal error encountered is kept. If
+// maxConcurrentStarts is greater than zero, it limits the number of manifold
+// workers that may be starting up at the same time; this is useful to avoid
+// a thundering herd of workers all dialing the API server at once when an
+// agent with many manifolds starts from cold. A worker that keeps failing is
+// restarted with exponentially increasing delay, doubling errorDelay on
+// every consecutive failure up to maxDelay, plus jitter drawn from a
+// generator seeded with jitterSeed. A zero or negative maxDelay is treated
+// as "no cap specified" and replaced with defaultMaxDelay, rather than
+// genuinely uncapped, so a long-lived crash loop can't back off forever.
+func NewEngine(
+	isFatal func(error) bool,
+	worstError func(err0, err1 error) error,
+	errorDelay, bounceDelay, maxDelay time.Duration,
+	jitterSeed int64,
+	maxConcurrentStarts int,
+) Engine {
+	if worstError == nil {
+		worstError = firstError
+	}
+	if maxDelay <= 0 {
+		maxDelay = defaultMaxDelay
+	}
+	var startTokens chan struct{}
+	if maxConcurrentStarts > 0 {
+		startTokens = make(chan struct{}, maxConcurrentStarts)
+		for i := 0; i < maxConcurrentStarts; i++ {
+			startTokens <- struct{}{}
+		}
+	}
 	engine := &engine{
 		isFatal:     isFatal,
+		worstError:  worstError,
 		errorDelay:  errorDelay,
 		bounceDelay: bounceDelay,
-
-		manifolds:  map[string]Manifold{},
-		dependents: map[string][]string{},
-		current:    map[string]workerInfo{},
-
-		install: make(chan installTicket),
-		started: make(chan startedTicket),
-		stopped: make(chan stoppedTicket),
+		maxDelay:    maxDelay,
+		rand:        rand.New(rand.NewSource(jitterSeed)),
+		startTokens: startTokens,
+
+		manifolds:   map[string]Manifold{},
+		dependents:  map[string][]string{},
+		current:     map[string]workerInfo{},
+		generations: map[string]*int64{},
+
+		install:   make(chan installTicket),
+		started:   make(chan startedTicket),
+		stopped:   make(chan stoppedTicket),
+		report:    make(chan reportTicket),
+		uninstall: make(chan uninstallTicket),
+		replace:   make(chan replaceTicket),
 	}
 	go func() {
 		defer engine.tomb.Done()
@@ -123,6 +292,12 @@ func (engine *engine) loop() error {
 			engine.gotStarted(ticket.name, ticket.worker)
 		case ticket := <-engine.stopped:
 			engine.gotStopped(ticket.name, ticket.error)
+		case ticket := <-engine.report:
+			ticket.result <- engine.gotReport()
+		case ticket := <-engine.uninstall:
+			ticket.result <- engine.gotUninstall(ticket.name)
+		case ticket := <-engine.replace:
+			ticket.result <- engine.gotReplace(ticket.name, ticket.manifold)
 		}
 		if engine.isDying() {
 			if engine.allStopped() {
@@ -140,7 +315,16 @@ func (engine *engine) Kill() {
 
 // Wait is part of the worker.Worker interface.
 func (engine *engine) Wait() error {
-	return engine.tomb.Wait()
+	// tomb.Wait blocks until loop has returned and stopped mutating
+	// fatalError, so it's safe to read here; and it must take priority over
+	// whatever tomb.Wait itself returns, because tomb only ever remembers
+	// the *first* reason it was killed with, while fatalError reflects
+	// whichever fatal error worstError judged most significant.
+	tombErr := engine.tomb.Wait()
+	if engine.fatalError != nil {
+		return engine.fatalError
+	}
+	return tombErr
 }
 
 // Install is part of the Engine interface. It can be called by from any external
@@ -156,6 +340,56 @@ func (engine *engine) Install(name string, manifold Manifold) error {
 	}
 }
 
+// Uninstall is part of the Engine interface. It can be called from any
+// external goroutine.
+func (engine *engine) Uninstall(name string) error {
+	result := make(chan error)
+	select {
+	case <-engine.tomb.Dying():
+		return errors.New("engine is shutting down")
+	case engine.uninstall <- uninstallTicket{name, result}:
+		return <-result
+	}
+}
+
+// Replace is part of the Engine interface. It can be called from any
+// external goroutine.
+func (engine *engine) Replace(name string, manifold Manifold) error {
+	result := make(chan error)
+	select {
+	case <-engine.tomb.Dying():
+		return errors.New("engine is shutting down")
+	case engine.replace <- replaceTicket{name, manifold, result}:
+		return <-result
+	}
+}
+
+// Report is part of the Engine interface. It can be called from any goroutine.
+func (engine *engine) Report() map[string]interface{} {
+	result := make(chan map[string]interface{})
+	select {
+	case <-engine.tomb.Dying():
+		return nil
+	case engine.report <- reportTicket{result}:
+		return <-result
+	}
+}
+
+// gotReport handles a request for a snapshot of engine state. It must only
+// be called from the loop goroutine.
+func (engine *engine) gotReport() map[string]interface{} {
+	manifolds := make(map[string]interface{}, len(engine.manifolds))
+	for name, manifold := range engine.manifolds {
+		entry := engine.current[name].report()
+		entry["inputs"] = manifold.Inputs
+		entry["dependents"] = engine.dependents[name]
+		manifolds[name] = entry
+	}
+	return map[string]interface{}{
+		"manifolds": manifolds,
+	}
+}
+
 // gotInstall handles the params originally supplied to Install. It must only be
 // called from the loop goroutine.
 func (engine *engine) gotInstall(name string, manifold Manifold) error {
@@ -173,10 +407,50 @@ func (engine *engine) gotInstall(name string, manifold Manifold) error {
 		engine.dependents[input] = append(engine.dependents[input], name)
 	}
 	engine.current[name] = workerInfo{}
+	engine.generations[name] = new(int64)
 	engine.start(name, 0)
 	return nil
 }
 
+// gotUninstall handles the params originally supplied to Uninstall. It must
+// only be called from the loop goroutine.
+func (engine *engine) gotUninstall(name string) error {
+	if _, found := engine.manifolds[name]; !found {
+		return nil
+	}
+	logger.Infof("uninstalling %s manifold...", name)
+	engine.scheduleUninstall(name, false)
+	return nil
+}
+
+// gotReplace handles the params originally supplied to Replace. It must only
+// be called from the loop goroutine.
+func (engine *engine) gotReplace(name string, manifold Manifold) error {
+	old, found := engine.manifolds[name]
+	if !found {
+		return errors.Errorf("%s manifold not installed", name)
+	}
+	for _, input := range manifold.Inputs {
+		if _, found := engine.manifolds[input]; !found {
+			return errors.Errorf("%s manifold depends on unknown %s manifold", name, input)
+		}
+	}
+	if err := checkAcyclic(engine.manifolds, name, manifold); err != nil {
+		return err
+	}
+	logger.Infof("replacing %s manifold...", name)
+	for _, input := range old.Inputs {
+		engine.dependents[input] = removeString(engine.dependents[input], name)
+	}
+	engine.manifolds[name] = manifold
+	for _, input := range manifold.Inputs {
+		engine.dependents[input] = append(engine.dependents[input], name)
+	}
+	engine.bounce(name)
+	engine.bounceDependents(name)
+	return nil
+}
+
 // start invokes a runWorker goroutine for the manifold with the supplied name.
 func (engine *engine) start(name string, delay time.Duration) {
 
@@ -202,67 +476,76 @@ func (engine *engine) start(name string, delay time.Duration) {
 	// goroutine.
 	info.starting = true
 	engine.current[name] = info
-	go engine.runWorker(name, manifold, delay)
+	go engine.runWorker(name, manifold, delay, engine.snapshotResources(manifold))
+}
+
+// resourceSnapshot is what runWorker's getResource closure knows about one
+// of the manifold's inputs: the worker and output func available when the
+// snapshot was taken, and enough to notice if that input has since changed.
+type resourceSnapshot struct {
+	worker     worker.Worker
+	output     OutputFunc
+	generation *int64
+	bounces    int64
+}
+
+// snapshotResources captures what a call to start manifold's worker needs
+// to know about its Inputs, reading engine.current and engine.generations
+// directly. It must only be called from the loop goroutine: the resulting
+// snapshot is safe to read from runWorker's own goroutine afterwards only
+// because every field in it is either copied by value or a pointer that's
+// subsequently only ever touched via sync/atomic.
+func (engine *engine) snapshotResources(manifold Manifold) map[string]resourceSnapshot {
+	snapshot := make(map[string]resourceSnapshot, len(manifold.Inputs))
+	for _, resourceName := range manifold.Inputs {
+		generation := engine.generations[resourceName]
+		if generation == nil {
+			// The input has been uninstalled; a fresh counter that never
+			// moves leaves getResource reporting it as ErrMissing.
+			generation = new(int64)
+		}
+		snapshot[resourceName] = resourceSnapshot{
+			worker:     engine.current[resourceName].worker,
+			output:     engine.manifolds[resourceName].Output,
+			generation: generation,
+			bounces:    atomic.LoadInt64(generation),
+		}
+	}
+	return snapshot
 }
 
 // runWorker starts the supplied manifold's worker and communicates it back to the
 // loop goroutine; waits for worker completion; and communicates any error encountered
 // back to the loop goroutine. It's intended to be run on its own goroutine, but
 // should only be called from the start method (which validates preconditions).
-func (engine *engine) runWorker(name string, manifold Manifold, delay time.Duration) {
-
-	// We snapshot the resources available at invocation time, rather than adding an
-	// additional communicate-resource-request channel. The latter approach is not
-	// unreasonable... but is prone to inelegant scrambles. For example:
-	//
-	//  * Install manifold A; loop starts worker A
-	//  * Install manifold B; loop starts worker B
-	//  * A communicates its worker back to loop; main thread bounces B
-	//  * B asks for A, gets A, doesn't react to bounce (*)
-	//  * B communicates its worker back to loop; loop kills it immediately in
-	//    response to earlier bounce
-	//  * loop starts worker B again, now everything's fine; but, still, yuck.
-	//
-	// The problem, of course, is in the (*); the main thread does know that B
-	// needs to bounce, and it could communicate that fact back via an error
-	// over a channel back into getResource; the StartFunc could then just return
-	// (say) that ErrResourceChanged and avoid the hassle of creating a worker.
-	//
-	// But there's a fundamental race regardless -- we could *always* see a new
-	// dependency land just after we cede control to user code in the dependent,
-	// and at that point we have to bounce a fresh worker. Reducing occurrences
-	// of this is laudable, but the complexity cost is too high for the benefits
-	// we see; and the chosen appproach behaves well in the (common) scenario
-	// detailed above:
-	//
-	//  * Install manifold A; loop starts worker A
-	//  * Install manifold B; loop starts worker B with empty resource snapshot
-	//  * A communicates its worker back to loop; main thread bounces B
-	//  * B asks for A, gets nothing, can actually just return a degenerate
-	//    worker that immediately exits nil (indicating "given the available
-	//    dependencies I have done everything I can possibly do, and nothing
-	//    actually went *wrong* specifically...").
-	//  * loop restarts worker B with an up-to-date snapshot, B works fine
-	//
-	// We assume that, in the common case, most workers run without error most
-	// of the time; and, thus, that the vast majority of worker startups will
-	// happen as an agent starts. StartFuncs should be comfortable with
-	// returning nil workers when hard dependencies are unmet; and workers
-	// should be prepared to be stopped at any time, as they must already be.
-	outputs := map[string]OutputFunc{}
-	workers := map[string]worker.Worker{}
-	for _, resourceName := range manifold.Inputs {
-		outputs[resourceName] = engine.manifolds[resourceName].Output
-		workers[resourceName] = engine.current[resourceName].worker
-	}
-	getResource := func(resourceName string, out interface{}) bool {
-		switch {
-		case workers[resourceName] == nil:
-			return false
-		case outputs[resourceName] == nil:
-			return out == nil
+func (engine *engine) runWorker(name string, manifold Manifold, delay time.Duration, resources map[string]resourceSnapshot) {
+
+	// getResource reports ErrResourceChanged for any input whose generation
+	// counter has moved on since resources was captured -- i.e. whose
+	// worker has been bounced, by the engine or by its own Filter, since
+	// this runWorker invocation began -- trusting the StartFunc to abandon
+	// its attempt and return that same error, per GetResourceFunc's doc
+	// comment. The engine already knows to restart any manifold whose
+	// worker exits with ErrResourceChanged, so there's nothing more for
+	// runWorker to do once that happens.
+	getResource := func(resourceName string, out interface{}) error {
+		resource, found := resources[resourceName]
+		if !found {
+			return errors.Errorf("%q is not declared as a dependency", resourceName)
+		}
+		if atomic.LoadInt64(resource.generation) != resource.bounces {
+			return ErrResourceChanged
 		}
-		return outputs[resourceName](workers[resourceName], out)
+		if resource.worker == nil {
+			return ErrMissing
+		}
+		if resource.output == nil {
+			if out != nil {
+				return ErrBadType
+			}
+			return nil
+		}
+		return resource.output(resource.worker, out)
 	}
 
 	// run is defined separately from its invocation so that the handling of its
@@ -277,9 +560,19 @@ func (engine *engine) runWorker(name string, manifold Manifold, delay time.Durat
 			logger.Infof("starting %s manifold worker", name)
 		}
 
+		if !engine.acquireStartToken() {
+			logger.Infof("not starting %s manifold worker (shutting down)", name)
+			return tomb.ErrDying
+		}
 		worker, err := manifold.Start(getResource)
 		if err != nil {
-			logger.Infof("failed to start %s manifold worker: %v", name, err)
+			engine.releaseStartToken()
+			err = filterError(manifold, err)
+			if err == ErrResourceChanged {
+				logger.Infof("restarting %s manifold worker (dependency changed)", name)
+			} else {
+				logger.Infof("failed to start %s manifold worker: %v", name, err)
+			}
 			return err
 		}
 
@@ -291,13 +584,25 @@ func (engine *engine) runWorker(name string, manifold Manifold, delay time.Durat
 		case engine.started <- startedTicket{name, worker}:
 			logger.Infof("registered %s manifold worker", name)
 		}
-		return worker.Wait()
+		engine.releaseStartToken()
+		return filterError(manifold, worker.Wait())
 	}
 
 	// It is vital that this ticket be sent.
 	engine.stopped <- stoppedTicket{name, run()}
 }
 
+// filterError applies manifold's Filter, if it has one, to err, so that a
+// worker's own error can be recast in terms the engine understands.
+// ErrResourceChanged is left untouched, because it's an engine-internal
+// signal rather than a worker error.
+func filterError(manifold Manifold, err error) error {
+	if err != nil && err != ErrResourceChanged && manifold.Filter != nil {
+		err = manifold.Filter(err)
+	}
+	return err
+}
+
 // gotStarted updates the engine to reflect the creation of a worker. It must
 // only be called from the loop goroutine.
 func (engine *engine) gotStarted(name string, worker worker.Worker) {
@@ -316,7 +621,11 @@ func (engine *engine) gotStarted(name string, worker worker.Worker) {
 		logger.Infof("%s manifold worker started: %v", name, worker)
 		info.starting = false
 		info.worker = worker
+		info.startedAt = time.Now()
+		info.lastError = nil
+		info.consecutiveErrors = 0
 		engine.current[name] = info
+		atomic.AddInt64(engine.generations[name], 1)
 
 		// Any manifold that declares this one as an input needs to be restarted.
 		engine.bounceDependents(name)
@@ -334,30 +643,81 @@ func (engine *engine) gotStopped(name string, err error) {
 		engine.tomb.Kill(errors.New("fatal: unexpected %s manifold worker stop"))
 		return
 	}
+	hadWorker := info.worker != nil
+	wasStopping := info.stopping
+	wasUninstalling := info.uninstalling
+
+	// Reset the live parts of engine info, but keep the restart/error
+	// history around so it's still visible via Report.
+	info.starting = false
+	info.stopping = false
+	info.uninstalling = false
+	info.worker = nil
+	info.startedAt = time.Time{}
+	info.lastError = err
+	engine.current[name] = info
+	if hadWorker {
+		atomic.AddInt64(engine.generations[name], 1)
+	}
 
-	// Reset engine info...
-	engine.current[name] = workerInfo{}
+	restart := func(delay time.Duration) {
+		info.restartCount++
+		engine.current[name] = info
+		engine.start(name, delay)
+	}
+
+	// If this manifold was on its way out, finish the job instead of
+	// considering a restart; nothing below is relevant any more.
+	if wasUninstalling {
+		engine.finishUninstall(name)
+		return
+	}
+
+	// A StartFunc that saw one of its inputs change mid-start isn't a
+	// failure: the engine already knows it needs to restart this manifold,
+	// so just do that, the same way we would if we'd bounced it ourselves.
+	if err == ErrResourceChanged {
+		restart(engine.bounceDelay)
+		return
+	}
+
+	// A worker (or its manifold's Filter) can ask to be restarted straight
+	// away, bypassing the usual errorDelay.
+	if err == ErrBounce {
+		restart(engine.bounceDelay)
+		return
+	}
+
+	// ...or to be removed from the engine entirely, along with everything
+	// that depends on it, since none of them can run without it.
+	if err == ErrUninstall {
+		engine.scheduleUninstall(name, true)
+		return
+	}
 
 	// ...and bail out if we can be sure there's no need to restart.
 	if engine.isFatal(err) {
-		engine.tomb.Kill(err)
+		engine.die(err)
 		return
 	}
 
 	// If the worker stopped on its own, without error, it's finished its job
 	// and won't be run again unless its dependencies change. Otherwise...
 	if err != nil {
-		// Something went wrong, but we don't much care what. Try again in a bit.
-		engine.start(name, engine.errorDelay)
-	} else if info.stopping {
+		// Something went wrong, but we don't much care what. Try again after
+		// a delay that backs off the more consecutive errors we've seen, so
+		// a persistently broken manifold doesn't spin at a steady cadence.
+		info.consecutiveErrors++
+		restart(engine.backoffDelay(info.consecutiveErrors))
+	} else if wasStopping {
 		// We told it to stop, because its dependencies changed; we want to
 		// start it again immediately.
-		engine.start(name, engine.bounceDelay)
+		restart(engine.bounceDelay)
 	}
 
 	// Manifolds that declared a dependency on this one only need to be notified
 	// if the worker has changed; if it was already nil, nobody needs to know.
-	if info.worker != nil {
+	if hadWorker {
 		engine.bounceDependents(name)
 	}
 }
@@ -380,6 +740,55 @@ func (engine *engine) stop(name string) {
 	engine.current[name] = info
 }
 
+// acquireStartToken blocks until a start token is available, returning true,
+// or until the engine starts shutting down, in which case it returns false
+// without acquiring anything. It's a no-op, and always returns true, if no
+// limit on concurrent starts was configured.
+func (engine *engine) acquireStartToken() bool {
+	if engine.startTokens == nil {
+		return true
+	}
+	select {
+	case <-engine.startTokens:
+		return true
+	case <-engine.tomb.Dying():
+		return false
+	}
+}
+
+// releaseStartToken returns a token acquired via acquireStartToken. It's a
+// no-op if no limit on concurrent starts was configured.
+func (engine *engine) releaseStartToken() {
+	if engine.startTokens != nil {
+		engine.startTokens <- struct{}{}
+	}
+}
+
+// backoffDelay returns how long to wait before restarting a worker that has
+// failed consecutiveErrors times in a row: errorDelay doubled once for each
+// consecutive failure, capped at maxDelay (which NewEngine guarantees is
+// always positive, so this can never double past it into overflow), plus
+// uniform jitter in [0, delay/2) so that many workers crash-looping together
+// don't all retry in lockstep.
+func (engine *engine) backoffDelay(consecutiveErrors int) time.Duration {
+	delay := engine.errorDelay
+	for i := 0; i < consecutiveErrors; i++ {
+		if delay >= engine.maxDelay {
+			delay = engine.maxDelay
+			break
+		}
+		delay *= 2
+	}
+	if delay > engine.maxDelay {
+		delay = engine.maxDelay
+	}
+	jitter := int64(delay) / 2
+	if jitter <= 0 {
+		return delay
+	}
+	return delay + time.Duration(engine.rand.Int63n(jitter))
+}
+
 // isDying returns true if the engine is shutting down.
 func (engine *engine) isDying() bool {
 	select {
@@ -400,15 +809,131 @@ func (engine *engine) allStopped() bool {
 	return true
 }
 
-// bounceDependents starts every stopped dependent of the named manifold, and
-// stops every started one (and trusts the rest of the engine to restart them).
+// bounce starts the named manifold's worker if it's stopped, and stops it
+// otherwise, trusting the rest of the engine to restart it once it's ready.
 // It must only be called from the loop goroutine.
+func (engine *engine) bounce(name string) {
+	if engine.current[name].stopped() {
+		engine.start(name, engine.bounceDelay)
+	} else {
+		engine.stop(name)
+	}
+}
+
+// bounceDependents bounces every dependent of the named manifold. It must
+// only be called from the loop goroutine.
 func (engine *engine) bounceDependents(name string) {
 	for _, name := range engine.dependents[name] {
-		if engine.current[name].stopped() {
-			engine.start(name, engine.bounceDelay)
-		} else {
-			engine.stop(name)
+		if engine.current[name].uninstalling {
+			continue
+		}
+		engine.bounce(name)
+	}
+}
+
+// die kills the engine, using worstError to decide whether err displaces
+// any fatal error already recorded. It must only be called from the loop
+// goroutine, and only with a non-nil err.
+func (engine *engine) die(err error) {
+	if engine.fatalError != nil {
+		err = engine.worstError(engine.fatalError, err)
+	}
+	engine.fatalError = err
+	engine.tomb.Kill(err)
+}
+
+// firstError is the default worstError func: it keeps whichever error was
+// recorded first, on the assumption that later errors are likely to be
+// just fallout from the engine already tearing itself down.
+func firstError(err0, err1 error) error {
+	return err0
+}
+
+// scheduleUninstall marks the named manifold to be removed as soon as its
+// worker (if any) has stopped. If cascade is true, every manifold that
+// transitively depends on it is marked for removal too, rather than merely
+// bounced once the named manifold is gone: this is what lets a worker signal
+// ErrUninstall and have the engine tear down its whole dependent subtree, as
+// documented on ErrUninstall, without forcing the same all-or-nothing
+// behaviour on the public Uninstall method. It must only be called from the
+// loop goroutine.
+func (engine *engine) scheduleUninstall(name string, cascade bool) {
+	info, found := engine.current[name]
+	if !found || info.uninstalling {
+		return
+	}
+	info.uninstalling = true
+	engine.current[name] = info
+	if cascade {
+		for _, dependent := range engine.dependents[name] {
+			engine.scheduleUninstall(dependent, true)
+		}
+	}
+	engine.stop(name)
+	if info.stopped() {
+		engine.finishUninstall(name)
+	}
+}
+
+// finishUninstall removes all record of the named manifold, and bounces
+// every dependent that isn't itself being uninstalled, so it notices the
+// manifold's absence. It must only be called from the loop goroutine, once
+// the manifold's worker (if any) has completely stopped.
+func (engine *engine) finishUninstall(name string) {
+	logger.Infof("uninstalled %s manifold", name)
+	manifold := engine.manifolds[name]
+	dependents := engine.dependents[name]
+	for _, input := range manifold.Inputs {
+		engine.dependents[input] = removeString(engine.dependents[input], name)
+	}
+	delete(engine.manifolds, name)
+	delete(engine.dependents, name)
+	delete(engine.current, name)
+	delete(engine.generations, name)
+	for _, dependent := range dependents {
+		if engine.current[dependent].uninstalling {
+			// Already being torn down as part of the same cascade; it'll
+			// finish itself off once its own worker stops, and doesn't need
+			// to be bounced in the meantime.
+			continue
+		}
+		engine.bounce(dependent)
+	}
+}
+
+// checkAcyclic reports an error if, were manifold substituted for name's
+// current definition, name would end up (directly or transitively)
+// depending on itself. It assumes the rest of manifolds is already acyclic,
+// which gotInstall's "Inputs must already be installed" rule guarantees.
+func checkAcyclic(manifolds map[string]Manifold, name string, manifold Manifold) error {
+	visited := map[string]bool{}
+	var visit func(inputs []string) error
+	visit = func(inputs []string) error {
+		for _, input := range inputs {
+			if input == name {
+				return errors.Errorf("%s manifold cannot depend on itself", name)
+			}
+			if visited[input] {
+				continue
+			}
+			visited[input] = true
+			if err := visit(manifolds[input].Inputs); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return visit(manifold.Inputs)
+}
+
+// removeString returns a slice with the first occurrence of s removed.
+func removeString(slice []string, s string) []string {
+	for i, value := range slice {
+		if value == s {
+			result := make([]string, 0, len(slice)-1)
+			result = append(result, slice[:i]...)
+			return append(result, slice[i+1:]...)
 		}
 	}
+	return slice
 }
@@ -0,0 +1,615 @@
+package dependency
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/juju/juju/worker"
+)
+
+// fakeWorker is a minimal worker.Worker that a test controls directly,
+// without depending on any real worker implementation.
+type fakeWorker struct {
+	mu   sync.Mutex
+	dead chan struct{}
+	err  error
+}
+
+func newFakeWorker() *fakeWorker {
+	return &fakeWorker{dead: make(chan struct{})}
+}
+
+// finish causes Wait to return err.
+func (w *fakeWorker) finish(err error) {
+	w.mu.Lock()
+	w.err = err
+	w.mu.Unlock()
+	w.Kill()
+}
+
+// Kill is part of the worker.Worker interface.
+func (w *fakeWorker) Kill() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	select {
+	case <-w.dead:
+	default:
+		close(w.dead)
+	}
+}
+
+// Wait is part of the worker.Worker interface.
+func (w *fakeWorker) Wait() error {
+	<-w.dead
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// waitUntil polls condition until it's true, failing the test if timeout
+// elapses first.
+func waitUntil(t *testing.T, timeout time.Duration, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("timed out waiting for condition")
+}
+
+func installed(engine Engine, name string) bool {
+	report := engine.Report()
+	manifolds, _ := report["manifolds"].(map[string]interface{})
+	_, found := manifolds[name]
+	return found
+}
+
+// manifoldReport returns the named manifold's entry from engine.Report(),
+// or nil if it's not installed.
+func manifoldReport(engine Engine, name string) map[string]interface{} {
+	report := engine.Report()
+	manifolds, _ := report["manifolds"].(map[string]interface{})
+	entry, _ := manifolds[name].(map[string]interface{})
+	return entry
+}
+
+// TestGetResourceReportsResourceChanged checks that a GetResourceFunc call
+// returns ErrResourceChanged for an input that's been bounced since the
+// StartFunc using it was invoked, per GetResourceFunc's doc comment.
+func TestGetResourceReportsResourceChanged(t *testing.T) {
+	engine := NewEngine(
+		func(error) bool { return false },
+		nil,
+		time.Millisecond, time.Millisecond, time.Millisecond,
+		0, 0,
+	)
+	defer func() {
+		engine.Kill()
+		engine.Wait()
+	}()
+
+	dep := newFakeWorker()
+	err := engine.Install("dep", Manifold{
+		Start: func(GetResourceFunc) (worker.Worker, error) {
+			return dep, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("install dep: %v", err)
+	}
+
+	// dependent's Start blocks until the test lets it proceed, so its
+	// resource snapshot -- taken when Install returns, well before that --
+	// is guaranteed to predate the bounce below.
+	proceed := make(chan struct{})
+	results := make(chan error, 1)
+	err = engine.Install("dependent", Manifold{
+		Inputs: []string{"dep"},
+		Start: func(getResource GetResourceFunc) (worker.Worker, error) {
+			<-proceed
+			err := getResource("dep", nil)
+			results <- err
+			return nil, err
+		},
+	})
+	if err != nil {
+		t.Fatalf("install dependent: %v", err)
+	}
+
+	dep.finish(errors.New("boom"))
+	waitUntil(t, time.Second, func() bool {
+		entry := manifoldReport(engine, "dep")
+		count, _ := entry["restart-count"].(int)
+		return count >= 1
+	})
+	close(proceed)
+
+	select {
+	case err := <-results:
+		if err != ErrResourceChanged {
+			t.Fatalf("getResource returned %v, want ErrResourceChanged", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("dependent's Start never called getResource")
+	}
+}
+
+// TestUninstallViaFilterCascadesToDependents checks that a Filter
+// translating a worker's error into ErrUninstall removes not just that
+// manifold but every manifold that (transitively) depends on it, per
+// ErrUninstall's doc comment.
+func TestUninstallViaFilterCascadesToDependents(t *testing.T) {
+	engine := NewEngine(
+		func(error) bool { return false },
+		nil,
+		time.Millisecond, time.Millisecond, time.Millisecond,
+		0, 0,
+	)
+	defer func() {
+		engine.Kill()
+		engine.Wait()
+	}()
+
+	root := newFakeWorker()
+	err := engine.Install("root", Manifold{
+		Start: func(GetResourceFunc) (worker.Worker, error) {
+			return root, nil
+		},
+		Filter: func(error) error {
+			return ErrUninstall
+		},
+	})
+	if err != nil {
+		t.Fatalf("install root: %v", err)
+	}
+
+	leaf := newFakeWorker()
+	err = engine.Install("leaf", Manifold{
+		Inputs: []string{"root"},
+		Start: func(GetResourceFunc) (worker.Worker, error) {
+			return leaf, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("install leaf: %v", err)
+	}
+
+	// Whatever error root's worker exits with, its Filter turns it into
+	// ErrUninstall, which should take leaf down with it.
+	root.finish(errors.New("boom"))
+
+	waitUntil(t, time.Second, func() bool {
+		return !installed(engine, "root") && !installed(engine, "leaf")
+	})
+}
+
+// TestReplaceRejectsIndirectCycle checks that Replace refuses to introduce a
+// dependency cycle even when the cycle runs through another manifold rather
+// than back to name directly.
+func TestReplaceRejectsIndirectCycle(t *testing.T) {
+	engine := NewEngine(
+		func(error) bool { return false },
+		nil,
+		time.Millisecond, time.Millisecond, time.Millisecond,
+		0, 0,
+	)
+	defer func() {
+		engine.Kill()
+		engine.Wait()
+	}()
+
+	newManifold := func(inputs ...string) Manifold {
+		return Manifold{
+			Inputs: inputs,
+			Start: func(GetResourceFunc) (worker.Worker, error) {
+				return newFakeWorker(), nil
+			},
+		}
+	}
+
+	if err := engine.Install("a", newManifold()); err != nil {
+		t.Fatalf("install a: %v", err)
+	}
+	if err := engine.Install("b", newManifold("a")); err != nil {
+		t.Fatalf("install b: %v", err)
+	}
+
+	// Replacing "a" to depend on "b" would close a cycle a -> b -> a.
+	err := engine.Replace("a", newManifold("b"))
+	if err == nil {
+		t.Fatal("Replace introduced a dependency cycle without error")
+	}
+}
+
+// TestUninstallBouncesDependentsWithoutRemovingThem checks that the public
+// Uninstall method removes only the named manifold, bouncing (rather than
+// removing) everything that depends on it -- unlike the cascading removal
+// triggered by a worker's Filter returning ErrUninstall.
+func TestUninstallBouncesDependentsWithoutRemovingThem(t *testing.T) {
+	engine := NewEngine(
+		func(error) bool { return false },
+		nil,
+		time.Millisecond, time.Millisecond, time.Millisecond,
+		0, 0,
+	)
+	defer func() {
+		engine.Kill()
+		engine.Wait()
+	}()
+
+	root := newFakeWorker()
+	if err := engine.Install("root", Manifold{
+		Start: func(GetResourceFunc) (worker.Worker, error) {
+			return root, nil
+		},
+	}); err != nil {
+		t.Fatalf("install root: %v", err)
+	}
+	if err := engine.Install("leaf", Manifold{
+		Inputs: []string{"root"},
+		Start: func(GetResourceFunc) (worker.Worker, error) {
+			return newFakeWorker(), nil
+		},
+	}); err != nil {
+		t.Fatalf("install leaf: %v", err)
+	}
+
+	waitUntil(t, time.Second, func() bool {
+		entry := manifoldReport(engine, "leaf")
+		return entry != nil && entry["state"] == "running"
+	})
+	leafRestarts, _ := manifoldReport(engine, "leaf")["restart-count"].(int)
+
+	if err := engine.Uninstall("root"); err != nil {
+		t.Fatalf("uninstall root: %v", err)
+	}
+
+	waitUntil(t, time.Second, func() bool {
+		return !installed(engine, "root")
+	})
+	if !installed(engine, "leaf") {
+		t.Fatal("Uninstall removed leaf, a mere dependent, along with root")
+	}
+	waitUntil(t, time.Second, func() bool {
+		count, _ := manifoldReport(engine, "leaf")["restart-count"].(int)
+		return count > leafRestarts
+	})
+}
+
+// TestReplaceSwapsStartAndOutput checks that Replace's new Manifold actually
+// takes effect: its dependents see the replacement worker's output, not the
+// original's.
+func TestReplaceSwapsStartAndOutput(t *testing.T) {
+	engine := NewEngine(
+		func(error) bool { return false },
+		nil,
+		time.Millisecond, time.Millisecond, time.Millisecond,
+		0, 0,
+	)
+	defer func() {
+		engine.Kill()
+		engine.Wait()
+	}()
+
+	newManifold := func(value string) Manifold {
+		return Manifold{
+			Start: func(GetResourceFunc) (worker.Worker, error) {
+				return newFakeWorker(), nil
+			},
+			Output: func(in worker.Worker, out interface{}) error {
+				outPtr, ok := out.(*string)
+				if !ok {
+					return ErrBadType
+				}
+				*outPtr = value
+				return nil
+			},
+		}
+	}
+
+	if err := engine.Install("source", newManifold("original")); err != nil {
+		t.Fatalf("install source: %v", err)
+	}
+
+	results := make(chan string, 10)
+	if err := engine.Install("consumer", Manifold{
+		Inputs: []string{"source"},
+		Start: func(getResource GetResourceFunc) (worker.Worker, error) {
+			var value string
+			if err := getResource("source", &value); err != nil {
+				return nil, err
+			}
+			results <- value
+			return newFakeWorker(), nil
+		},
+	}); err != nil {
+		t.Fatalf("install consumer: %v", err)
+	}
+
+	select {
+	case value := <-results:
+		if value != "original" {
+			t.Fatalf("consumer saw %q, want %q", value, "original")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("consumer never started")
+	}
+
+	if err := engine.Replace("source", newManifold("replaced")); err != nil {
+		t.Fatalf("replace source: %v", err)
+	}
+
+	select {
+	case value := <-results:
+		if value != "replaced" {
+			t.Fatalf("consumer saw %q after Replace, want %q", value, "replaced")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("consumer never restarted after Replace")
+	}
+}
+
+// startCounter tracks how many manifold Start funcs are concurrently in
+// flight, and the high-water mark reached.
+type startCounter struct {
+	mu      sync.Mutex
+	current int
+	max     int
+}
+
+func (c *startCounter) enter() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.current++
+	if c.current > c.max {
+		c.max = c.current
+	}
+}
+
+func (c *startCounter) leave() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.current--
+}
+
+func (c *startCounter) highWater() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.max
+}
+
+// TestMaxConcurrentStartsLimitsConcurrency checks that no more than
+// maxConcurrentStarts manifold Start funcs ever run at once.
+func TestMaxConcurrentStartsLimitsConcurrency(t *testing.T) {
+	const limit = 2
+	engine := NewEngine(
+		func(error) bool { return false },
+		nil,
+		time.Millisecond, time.Millisecond, time.Millisecond,
+		0, limit,
+	)
+	defer func() {
+		engine.Kill()
+		engine.Wait()
+	}()
+
+	counter := &startCounter{}
+	release := make(chan struct{})
+	for _, name := range []string{"a", "b", "c", "d"} {
+		name := name
+		err := engine.Install(name, Manifold{
+			Start: func(GetResourceFunc) (worker.Worker, error) {
+				counter.enter()
+				<-release
+				counter.leave()
+				return newFakeWorker(), nil
+			},
+		})
+		if err != nil {
+			t.Fatalf("install %s: %v", name, err)
+		}
+	}
+
+	// Give every manifold a chance to reach (or queue behind) the token
+	// limiter before letting any of them actually finish starting.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	if highWater := counter.highWater(); highWater > limit {
+		t.Fatalf("observed %d concurrent starts, want at most %d", highWater, limit)
+	}
+}
+
+// TestStartTokenReleasedOnDying checks that a goroutine blocked in
+// acquireStartToken is released -- rather than left to deadlock -- once the
+// engine starts shutting down.
+func TestStartTokenReleasedOnDying(t *testing.T) {
+	engine := NewEngine(
+		func(error) bool { return false },
+		nil,
+		time.Millisecond, time.Millisecond, time.Millisecond,
+		0, 1,
+	).(*engine)
+
+	if !engine.acquireStartToken() {
+		t.Fatal("acquireStartToken failed with no contention")
+	}
+
+	result := make(chan bool, 1)
+	go func() { result <- engine.acquireStartToken() }()
+
+	// Give the goroutine above a chance to start waiting on the token that
+	// is already held.
+	time.Sleep(50 * time.Millisecond)
+	engine.Kill()
+
+	select {
+	case acquired := <-result:
+		if acquired {
+			t.Fatal("acquireStartToken returned true after the engine started dying")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("acquireStartToken never returned; a blocked waiter was not released on shutdown")
+	}
+
+	engine.releaseStartToken()
+	engine.Wait()
+}
+
+// TestBackoffDelayGrowsAndCaps checks that backoffDelay grows with
+// consecutiveErrors but never exceeds maxDelay by more than its jitter
+// allowance, regardless of how large consecutiveErrors gets.
+func TestBackoffDelayGrowsAndCaps(t *testing.T) {
+	engine := NewEngine(
+		func(error) bool { return false },
+		nil,
+		10*time.Millisecond, 10*time.Millisecond, 100*time.Millisecond,
+		1, 0,
+	).(*engine)
+	defer func() {
+		engine.Kill()
+		engine.Wait()
+	}()
+
+	base := engine.errorDelay
+	for consecutiveErrors := 1; consecutiveErrors <= 20; consecutiveErrors++ {
+		if base < engine.maxDelay {
+			base *= 2
+		}
+		want := base
+		if want > engine.maxDelay {
+			want = engine.maxDelay
+		}
+		delay := engine.backoffDelay(consecutiveErrors)
+		if delay < want {
+			t.Fatalf("consecutiveErrors=%d: delay %v below expected base %v", consecutiveErrors, delay, want)
+		}
+		if bound := engine.maxDelay + engine.maxDelay/2 + 1; delay > bound {
+			t.Fatalf("consecutiveErrors=%d: delay %v exceeds maxDelay+jitter bound %v", consecutiveErrors, delay, bound)
+		}
+	}
+}
+
+// TestNewEngineDefaultsNonPositiveMaxDelay checks that NewEngine refuses to
+// leave maxDelay at a non-positive value, so backoffDelay can never double
+// its way into an int64 overflow.
+func TestNewEngineDefaultsNonPositiveMaxDelay(t *testing.T) {
+	engine := NewEngine(
+		func(error) bool { return false },
+		nil,
+		time.Millisecond, time.Millisecond, 0,
+		2, 0,
+	).(*engine)
+	defer func() {
+		engine.Kill()
+		engine.Wait()
+	}()
+
+	if engine.maxDelay <= 0 {
+		t.Fatalf("NewEngine left maxDelay non-positive: %v", engine.maxDelay)
+	}
+	if delay := engine.backoffDelay(1000); delay <= 0 {
+		t.Fatalf("backoffDelay(1000) produced a non-positive delay: %v", delay)
+	}
+}
+
+// TestFilterRecastsPlainErrorIntoBounce checks that a Manifold's Filter can
+// turn an otherwise-unremarkable error into ErrBounce, forcing an immediate
+// restart rather than the usual (here, deliberately huge) errorDelay.
+func TestFilterRecastsPlainErrorIntoBounce(t *testing.T) {
+	engine := NewEngine(
+		func(error) bool { return false },
+		nil,
+		time.Hour, time.Millisecond, time.Hour,
+		0, 0,
+	)
+	defer func() {
+		engine.Kill()
+		engine.Wait()
+	}()
+
+	var mu sync.Mutex
+	starts := 0
+	err := engine.Install("flaky", Manifold{
+		Start: func(GetResourceFunc) (worker.Worker, error) {
+			mu.Lock()
+			starts++
+			first := starts == 1
+			mu.Unlock()
+			w := newFakeWorker()
+			if first {
+				w.finish(errors.New("transient"))
+			}
+			return w, nil
+		},
+		Filter: func(error) error {
+			return ErrBounce
+		},
+	})
+	if err != nil {
+		t.Fatalf("install flaky: %v", err)
+	}
+
+	// If Filter's ErrBounce weren't honoured, the second start would only
+	// happen after the one-hour errorDelay, and this would time out.
+	waitUntil(t, time.Second, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return starts >= 2
+	})
+}
+
+// TestWorstErrorConsultedOnConcurrentFatalErrors checks that, when two
+// workers die with fatal errors around the same time, the engine reports
+// whichever one worstError prefers, rather than just whichever happened to
+// be recorded first.
+func TestWorstErrorConsultedOnConcurrentFatalErrors(t *testing.T) {
+	errLosing := errors.New("alpha")
+	errWinning := errors.New("zzz-winner")
+	worst := func(err0, err1 error) error {
+		if err1.Error() > err0.Error() {
+			return err1
+		}
+		return err0
+	}
+	engine := NewEngine(
+		func(error) bool { return true },
+		worst,
+		time.Millisecond, time.Millisecond, time.Millisecond,
+		0, 0,
+	)
+
+	a := newFakeWorker()
+	if err := engine.Install("a", Manifold{
+		Start: func(GetResourceFunc) (worker.Worker, error) { return a, nil },
+	}); err != nil {
+		t.Fatalf("install a: %v", err)
+	}
+	b := newFakeWorker()
+	if err := engine.Install("b", Manifold{
+		Start: func(GetResourceFunc) (worker.Worker, error) { return b, nil },
+	}); err != nil {
+		t.Fatalf("install b: %v", err)
+	}
+
+	waitUntil(t, time.Second, func() bool {
+		ra := manifoldReport(engine, "a")
+		rb := manifoldReport(engine, "b")
+		return ra != nil && ra["state"] == "running" && rb != nil && rb["state"] == "running"
+	})
+
+	// Both workers die with a fatal error at (as near as a test can force)
+	// the same moment; worst should be consulted for whichever of the two
+	// the loop goroutine processes second.
+	a.finish(errLosing)
+	b.finish(errWinning)
+
+	if err := engine.Wait(); err != errWinning {
+		t.Fatalf("engine.Wait() = %v, want %v (the error worstError prefers)", err, errWinning)
+	}
+}
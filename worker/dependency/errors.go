@@ -0,0 +1,37 @@
+package dependency
+
+import (
+	"github.com/juju/errors"
+)
+
+var (
+	// ErrMissing indicates that a StartFunc cannot start a worker, and
+	// cannot become capable of doing so, without the named resource
+	// becoming available.
+	ErrMissing = errors.New("dependency not available")
+
+	// ErrBadType indicates that GetResourceFunc has been used to populate
+	// an output parameter that the named dependency cannot supply.
+	ErrBadType = errors.New("bad output type")
+
+	// ErrResourceChanged indicates that a StartFunc cannot start a worker
+	// because one of its declared inputs has changed since the StartFunc
+	// was invoked. The engine is already aware that it needs to restart
+	// the dependent, so a StartFunc that encounters this error should
+	// just return it unchanged rather than trying to do anything clever.
+	ErrResourceChanged = errors.New("dependency resource changed")
+
+	// ErrBounce indicates that, whatever a worker's exit error would
+	// otherwise imply, the engine should restart it immediately rather
+	// than waiting out the usual errorDelay. A Manifold's Filter can
+	// return this to avoid the delay for errors it knows to be
+	// transient.
+	ErrBounce = errors.New("bounced via filter")
+
+	// ErrUninstall indicates that a worker's manifold should be removed
+	// from the engine entirely -- along with every manifold that depends
+	// on it, since none of them can run without it -- rather than
+	// restarted. A Manifold's Filter can return this for errors it knows
+	// to be permanent.
+	ErrUninstall = errors.New("uninstalled via filter")
+)
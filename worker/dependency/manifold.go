@@ -0,0 +1,55 @@
+package dependency
+
+import (
+	"github.com/juju/juju/worker"
+)
+
+// Manifold defines the behaviour of a node in an Engine's dependency graph.
+type Manifold struct {
+
+	// Inputs lists the names of the manifolds which this manifold's worker
+	// needs to function correctly. All those names must be installed in
+	// the Engine before this manifold is.
+	Inputs []string
+
+	// Start is used to create a worker for the manifold. It must not be nil.
+	Start StartFunc
+
+	// Output is used to implement a GetResourceFunc for workers that declare
+	// a dependency on a manifold of this kind. It may be nil, in which case
+	// dependents will be unable to make any use of this manifold's worker.
+	Output OutputFunc
+
+	// Filter, if non-nil, is applied to the error returned by the worker
+	// before the engine sees it, so that the worker can recast its own
+	// errors in terms the engine understands -- for example, translating
+	// a transient network error into ErrBounce to force an immediate
+	// restart, or into ErrUninstall to have the engine give up on it for
+	// good. It is not applied to ErrResourceChanged.
+	Filter FilterFunc
+}
+
+// FilterFunc translates a worker's exit error into the error the engine
+// should actually act on.
+type FilterFunc func(error) error
+
+// StartFunc returns a worker or an error. It must not block for any time
+// longer than is needed to create the worker, and must not access the
+// supplied GetResourceFunc after returning.
+type StartFunc func(getResource GetResourceFunc) (worker.Worker, error)
+
+// GetResourceFunc is used within a StartFunc to access the dependencies
+// named in its Manifold's Inputs, and populate suitable output variables.
+//
+// If the named resource is not available, it returns ErrMissing; if out is
+// not a suitable output pointer for that resource, it returns ErrBadType;
+// and if the resource that contributed to the worker's own inputs has
+// itself been bounced since the StartFunc was invoked, it returns
+// ErrResourceChanged, and the StartFunc should abandon its attempt and
+// return that same error, trusting the engine to try again.
+type GetResourceFunc func(name string, out interface{}) error
+
+// OutputFunc populates out, which must be a pointer to a value of a type
+// expected by some dependent Manifold, with data coming from the supplied
+// worker. It must return ErrBadType if out is not of a suitable type.
+type OutputFunc func(in worker.Worker, out interface{}) error
@@ -0,0 +1,60 @@
+package dependency
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// Reporter is implemented by an Engine to expose a snapshot of its internal
+// state, for use by operators trying to work out why an agent isn't doing
+// what they expect.
+type Reporter interface {
+	// Report returns a map describing the inputs, dependents, and current
+	// state of every manifold installed in the engine. It is safe to call
+	// from any goroutine.
+	Report() map[string]interface{}
+}
+
+// NewReportHandler returns an http.Handler that renders the supplied
+// Reporter's Report as JSON, or as a human-readable summary if the request
+// sets an Accept header of "text/plain".
+func NewReportHandler(reporter Reporter) http.Handler {
+	return &reportHandler{reporter}
+}
+
+type reportHandler struct {
+	reporter Reporter
+}
+
+// ServeHTTP is part of the http.Handler interface.
+func (h *reportHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	report := h.reporter.Report()
+	if req.Header.Get("Accept") == "text/plain" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		writeTextReport(w, report)
+		return
+	}
+	body, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// writeTextReport renders report as a simple summary, one manifold per
+// line, ordered by name so that output is stable across calls.
+func writeTextReport(w http.ResponseWriter, report map[string]interface{}) {
+	manifolds, _ := report["manifolds"].(map[string]interface{})
+	names := make([]string, 0, len(manifolds))
+	for name := range manifolds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "%s: %v\n", name, manifolds[name])
+	}
+}
@@ -0,0 +1,128 @@
+package dependency
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/juju/juju/worker"
+)
+
+// TestReportShape checks that Engine.Report describes a manifold's state,
+// inputs, and dependents in the shape documented on workerInfo.report and
+// gotReport.
+func TestReportShape(t *testing.T) {
+	engine := NewEngine(
+		func(error) bool { return false },
+		nil,
+		time.Millisecond, time.Millisecond, time.Millisecond,
+		0, 0,
+	)
+	defer func() {
+		engine.Kill()
+		engine.Wait()
+	}()
+
+	err := engine.Install("root", Manifold{
+		Start: func(GetResourceFunc) (worker.Worker, error) {
+			return newFakeWorker(), nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("install root: %v", err)
+	}
+	err = engine.Install("leaf", Manifold{
+		Inputs: []string{"root"},
+		Start: func(GetResourceFunc) (worker.Worker, error) {
+			return newFakeWorker(), nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("install leaf: %v", err)
+	}
+
+	waitUntil(t, time.Second, func() bool {
+		entry := manifoldReport(engine, "leaf")
+		return entry != nil && entry["state"] == "running"
+	})
+
+	entry := manifoldReport(engine, "root")
+	if entry == nil {
+		t.Fatal("report missing root manifold")
+	}
+	if entry["state"] != "running" {
+		t.Fatalf("root state = %v, want running", entry["state"])
+	}
+	if _, found := entry["started-at"]; !found {
+		t.Fatal("report missing started-at for a running manifold")
+	}
+	if _, found := entry["restart-count"]; !found {
+		t.Fatal("report missing restart-count")
+	}
+	dependents, _ := entry["dependents"].([]string)
+	if len(dependents) != 1 || dependents[0] != "leaf" {
+		t.Fatalf("root dependents = %v, want [leaf]", dependents)
+	}
+}
+
+// stubReporter is a Reporter whose Report always returns a fixed value, for
+// testing reportHandler in isolation from a real engine.
+type stubReporter struct {
+	report map[string]interface{}
+}
+
+func (r stubReporter) Report() map[string]interface{} {
+	return r.report
+}
+
+// TestReportHandlerServesJSON checks that reportHandler renders the
+// Reporter's Report as JSON by default.
+func TestReportHandlerServesJSON(t *testing.T) {
+	reporter := stubReporter{report: map[string]interface{}{
+		"manifolds": map[string]interface{}{
+			"foo": map[string]interface{}{"state": "running"},
+		},
+	}}
+	handler := NewReportHandler(reporter)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if got := rec.Header().Get("Content-Type"); got != "application/json" {
+		t.Fatalf("Content-Type = %q, want application/json", got)
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("invalid JSON response: %v", err)
+	}
+	manifolds, _ := body["manifolds"].(map[string]interface{})
+	if _, found := manifolds["foo"]; !found {
+		t.Fatalf("response missing foo manifold: %v", body)
+	}
+}
+
+// TestReportHandlerServesTextOnRequest checks that reportHandler renders a
+// human-readable summary when asked for text/plain.
+func TestReportHandlerServesTextOnRequest(t *testing.T) {
+	reporter := stubReporter{report: map[string]interface{}{
+		"manifolds": map[string]interface{}{
+			"foo": map[string]interface{}{"state": "running"},
+		},
+	}}
+	handler := NewReportHandler(reporter)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept", "text/plain")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if got := rec.Header().Get("Content-Type"); got != "text/plain; charset=utf-8" {
+		t.Fatalf("Content-Type = %q, want text/plain; charset=utf-8", got)
+	}
+	if !strings.Contains(rec.Body.String(), "foo:") {
+		t.Fatalf("text report missing foo manifold line: %q", rec.Body.String())
+	}
+}